@@ -1,7 +1,13 @@
 package zcash
 
 import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"math/rand"
 	"net"
+	"os"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -9,10 +15,48 @@ import (
 	"github.com/btcsuite/btcd/wire"
 )
 
+// Bucket layout for the new/tried address tables. These mirror the shape of
+// Bitcoin's addrman: a large number of "new" buckets for addresses we have
+// only heard about, and a smaller number of "tried" buckets for addresses we
+// have actually completed a connection to. Each bucket holds at most
+// maxBucketSize entries; adding to a full bucket evicts its oldest entry.
+const (
+	numNewBuckets   = 256
+	numTriedBuckets = 64
+	maxBucketSize   = 64
+
+	// maxFailures is the number of consecutive failed connection attempts
+	// before an address is blacklisted outright.
+	maxFailures = 7
+)
+
 type Address struct {
 	netaddr     *wire.NetAddress
 	blacklisted bool
 	lastUpdate  time.Time
+
+	// source is the IP of the peer that told us about this address. Its
+	// netgroup is hashed together with the address's own key to pick the
+	// new-table bucket; since each distinct address hashes separately,
+	// addresses reported from a single netblock still spread across many
+	// buckets.
+	source net.IP
+
+	attempts    int
+	lastAttempt time.Time
+	lastSuccess time.Time
+
+	// tried is true once the address has been promoted out of the new
+	// table by a successful connection.
+	tried     bool
+	bucketIdx int
+
+	// blacklistedAt and retryCount are only meaningful while the address
+	// lives in AddressBook.blacklist; retryCount grows every time
+	// RetryBlacklist selects this address for re-probing, which is what
+	// drives the exponential backoff in blacklistRetryReady.
+	blacklistedAt time.Time
+	retryCount    int
 }
 
 func (a *Address) String() string {
@@ -65,70 +109,418 @@ func (a *Address) MarshalText() (text []byte, err error) {
 	return []byte(a.String()), nil
 }
 
+// onionCatPrefix is the IPv6 prefix (fd87:d87e:eb43::/48) used to embed a Tor
+// onion address inside a wire.NetAddress, per the OnionCat convention that
+// Bitcoin Core and btcd also rely on.
+var onionCatPrefix = []byte{0xFD, 0x87, 0xD8, 0x7E, 0xEB, 0x43}
+
+// Group returns the netgroup this address belongs to, for use in diversity
+// selection: a /16 for IPv4, a /32 for IPv6, and the full address (i.e. its
+// own, one-member group) for a Tor v2/v3 onion address, since two different
+// hidden services sharing a netgroup would be a coincidence, not a sign of
+// shared infrastructure.
+func (a *Address) Group() string {
+	ip := a.netaddr.IP
+	if v6 := ip.To16(); ip.To4() == nil && v6 != nil && bytes.HasPrefix(v6, onionCatPrefix) {
+		return "onion:" + ip.String()
+	}
+	return group(ip)
+}
+
+// group collapses an IP to the network prefix used for bucket selection: a
+// /16 for IPv4 and a /32 for IPv6. It returns the empty string for a nil or
+// unparseable IP so that such addresses all share one (empty) netgroup
+// rather than panicking.
+func group(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return "4:" + net.IPv4Mask(255, 255, 0, 0).String() + ":" + v4.Mask(net.CIDRMask(16, 32)).String()
+	}
+
+	v6 := ip.To16()
+	if v6 == nil {
+		return ""
+	}
+	return "6:" + v6.Mask(net.CIDRMask(32, 128)).String()
+}
+
+// bucketHash derives a stable, uniformly distributed index in [0, mod) from
+// a peer key and a netgroup string.
+func bucketHash(key PeerKey, grp string, mod int) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{'|'})
+	h.Write([]byte(grp))
+	return int(h.Sum64() % uint64(mod))
+}
+
+func newBucketFor(key PeerKey, source net.IP) int {
+	return bucketHash(key, group(source), numNewBuckets)
+}
+
+func triedBucketFor(key PeerKey, peerIP net.IP) int {
+	return bucketHash(key, group(peerIP), numTriedBuckets)
+}
+
 type AddressBook struct {
-	addrs        map[PeerKey]*Address
-	addrState    sync.RWMutex
-	addrRecvCond *sync.Cond
+	addrs map[PeerKey]*Address
+
+	// blacklist holds addresses that have been blacklisted, keyed the same
+	// way as addrs. A blacklisted address is removed from addrs and its
+	// bucket, so it takes no further part in PickAddress/GetShuffledAddressList
+	// until Redeem moves it back.
+	blacklist map[PeerKey]*Address
+
+	newBuckets   [numNewBuckets][]PeerKey
+	triedBuckets [numTriedBuckets][]PeerKey
+
+	addrState sync.RWMutex
+
+	// addrRecv is signalled, non-blockingly, every time Add accepts a new
+	// address. WaitForAddresses selects on it alongside a timeout instead
+	// of using a sync.Cond, which has no way to wake a waiter that should
+	// give up.
+	addrRecv chan struct{}
+
+	// journalFile, when non-nil, receives an append-only record of
+	// Add/Blacklist/Touch events so they can be replayed after a crash
+	// between snapshots. See EnableJournal in address_book_persist.go.
+	journalMu   sync.Mutex
+	journalFile *os.File
+	journalPath string
 }
 
 func NewAddressBook() *AddressBook {
-	addrBook := &AddressBook{
-		addrs: make(map[PeerKey]*Address),
+	return &AddressBook{
+		addrs:     make(map[PeerKey]*Address),
+		blacklist: make(map[PeerKey]*Address),
+		addrRecv:  make(chan struct{}, 1),
 	}
-	addrBook.addrRecvCond = sync.NewCond(&addrBook.addrState)
-	return addrBook
 }
 
-func (bk *AddressBook) Add(s PeerKey) {
+// signalAddrRecv wakes a waiting WaitForAddresses caller, if any, without
+// blocking the caller that just added an address. The channel holds one
+// pending signal, so with several concurrent waiters only one is woken per
+// signal.
+func (bk *AddressBook) signalAddrRecv() {
+	select {
+	case bk.addrRecv <- struct{}{}:
+	default:
+	}
+}
+
+// addToBucket appends key to the bucket, evicting the oldest entry first
+// if the bucket is already full. The evicted key, if any, is returned so the
+// caller can decide what to do with it.
+func addToBucket(buckets *[]PeerKey, key PeerKey) (evicted PeerKey, didEvict bool) {
+	if len(*buckets) >= maxBucketSize {
+		evicted = (*buckets)[0]
+		*buckets = (*buckets)[1:]
+		didEvict = true
+	}
+	*buckets = append(*buckets, key)
+	return evicted, didEvict
+}
+
+func removeFromBucket(buckets *[]PeerKey, key PeerKey) {
+	for i, k := range *buckets {
+		if k == key {
+			*buckets = append((*buckets)[:i], (*buckets)[i+1:]...)
+			return
+		}
+	}
+}
+
+// Add records a newly heard-of address, sourced from sourceIP, in a new-table
+// bucket. If the address is already known it is left in its current table
+// and only its metadata is refreshed.
+func (bk *AddressBook) Add(s PeerKey, sourceIP net.IP) {
+	bk.addrState.Lock()
+
+	if _, blacklisted := bk.blacklist[s]; blacklisted {
+		// Gossip about a blacklisted peer doesn't revive it; only an
+		// explicit Redeem does.
+		bk.addrState.Unlock()
+		return
+	}
+
+	if existing, ok := bk.addrs[s]; ok {
+		existing.lastUpdate = time.Now()
+		bk.addrState.Unlock()
+		bk.signalAddrRecv()
+		bk.appendJournal(journalRecord{Event: journalEventAdd, Key: string(s), Source: sourceIP.String()})
+		return
+	}
+
 	newAddr, err := (&Address{}).fromPeerKey(s)
 	if err != nil {
 		// XXX effectively NOP bogus peer strings
+		bk.addrState.Unlock()
 		return
 	}
+	newAddr.source = sourceIP
+
+	idx := newBucketFor(s, sourceIP)
+	evicted, didEvict := addToBucket(&bk.newBuckets[idx], s)
+	newAddr.bucketIdx = idx
 
-	bk.addrState.Lock()
 	bk.addrs[s] = newAddr
+	if didEvict {
+		delete(bk.addrs, evicted)
+	}
+
 	bk.addrState.Unlock()
 
 	// Wake anyone who was waiting on us to receive an address.
-	bk.addrRecvCond.Broadcast()
+	bk.signalAddrRecv()
+	bk.appendJournal(journalRecord{Event: journalEventAdd, Key: string(s), Source: sourceIP.String()})
+}
+
+// MarkGood promotes an address to the tried table following a successful
+// connection. If the destination bucket is full, the oldest entry in it is
+// demoted back into a new-table bucket rather than being discarded.
+func (bk *AddressBook) MarkGood(s PeerKey) {
+	bk.addrState.Lock()
+	defer bk.addrState.Unlock()
+
+	target, ok := bk.addrs[s]
+	if !ok {
+		return
+	}
+
+	if target.tried {
+		removeFromBucket(&bk.triedBuckets[target.bucketIdx], s)
+	} else {
+		removeFromBucket(&bk.newBuckets[target.bucketIdx], s)
+	}
+
+	idx := triedBucketFor(s, target.netaddr.IP)
+	evicted, didEvict := addToBucket(&bk.triedBuckets[idx], s)
+	if didEvict {
+		if evictedAddr, ok := bk.addrs[evicted]; ok {
+			evictedAddr.tried = false
+			evictedIdx := newBucketFor(evicted, evictedAddr.source)
+			if lost, evictedAgain := addToBucket(&bk.newBuckets[evictedIdx], evicted); evictedAgain {
+				// The new bucket it landed in was also full; the
+				// address that lost that race is simply dropped.
+				delete(bk.addrs, lost)
+			}
+			evictedAddr.bucketIdx = evictedIdx
+		}
+	}
+
+	target.tried = true
+	target.bucketIdx = idx
+	target.attempts = 0
+	target.lastSuccess = time.Now()
+	target.lastUpdate = time.Now()
+}
+
+// MarkAttempt records a connection attempt against an address, whether or
+// not it succeeded.
+func (bk *AddressBook) MarkAttempt(s PeerKey) {
+	bk.addrState.Lock()
+	defer bk.addrState.Unlock()
+
+	if target, ok := bk.addrs[s]; ok {
+		target.attempts++
+		target.lastAttempt = time.Now()
+	}
+}
+
+// MarkBad records a failed connection attempt. Once an address has
+// accumulated maxFailures consecutive failures it is blacklisted.
+func (bk *AddressBook) MarkBad(s PeerKey) {
+	bk.addrState.Lock()
+	target, ok := bk.addrs[s]
+	if !ok {
+		bk.addrState.Unlock()
+		return
+	}
+
+	target.attempts++
+	target.lastAttempt = time.Now()
+	shouldBlacklist := target.attempts >= maxFailures
+
+	if shouldBlacklist {
+		if target.tried {
+			removeFromBucket(&bk.triedBuckets[target.bucketIdx], s)
+		} else {
+			removeFromBucket(&bk.newBuckets[target.bucketIdx], s)
+		}
+	}
+	bk.addrState.Unlock()
+
+	if shouldBlacklist {
+		bk.Blacklist(s)
+	}
 }
 
 func (bk *AddressBook) Remove(s PeerKey) {
 	bk.addrState.Lock()
 	defer bk.addrState.Unlock()
 
-	if _, ok := bk.addrs[s]; ok {
+	if target, ok := bk.addrs[s]; ok {
+		if target.tried {
+			removeFromBucket(&bk.triedBuckets[target.bucketIdx], s)
+		} else {
+			removeFromBucket(&bk.newBuckets[target.bucketIdx], s)
+		}
 		delete(bk.addrs, s)
 	}
+	delete(bk.blacklist, s)
 }
 
+// Blacklist moves s out of the active new/tried tables and into the
+// blacklist, where it sits until Redeem brings it back. RetryBlacklist only
+// selects it for re-probing; it does not move it out of the blacklist.
 func (bk *AddressBook) Blacklist(s PeerKey) {
 	bk.addrState.Lock()
-	defer bk.addrState.Unlock()
 
 	if target, ok := bk.addrs[s]; ok {
+		if target.tried {
+			removeFromBucket(&bk.triedBuckets[target.bucketIdx], s)
+		} else {
+			removeFromBucket(&bk.newBuckets[target.bucketIdx], s)
+		}
+		delete(bk.addrs, s)
+
 		target.blacklisted = true
-		target.lastUpdate = time.Now()
+		target.blacklistedAt = time.Now()
+		target.lastUpdate = target.blacklistedAt
+		bk.blacklist[s] = target
+	} else if target, ok := bk.blacklist[s]; ok {
+		target.blacklistedAt = time.Now()
+		target.lastUpdate = target.blacklistedAt
 	} else {
 		// Create a new Address just to be blacklisted
 		addr, err := (&Address{}).fromPeerKey(s)
 		if err != nil {
 			// XXX effectively NOP bogus peer strings
+			bk.addrState.Unlock()
 			return
 		}
 		addr.blacklisted = true
-		bk.addrs[s] = addr
+		addr.blacklistedAt = time.Now()
+		bk.blacklist[s] = addr
+	}
+
+	bk.addrState.Unlock()
+	bk.appendJournal(journalRecord{Event: journalEventBlacklist, Key: string(s)})
+}
+
+// Redeem moves a blacklisted address back into the active new/tried tables,
+// preserving whatever tried/new state it had before being blacklisted.
+// retryCount is left untouched so a peer that keeps failing after being
+// redeemed continues to back off on its original schedule.
+func (bk *AddressBook) Redeem(s PeerKey) {
+	bk.addrState.Lock()
+	defer bk.addrState.Unlock()
+
+	target, ok := bk.blacklist[s]
+	if !ok {
+		return
+	}
+	delete(bk.blacklist, s)
+
+	target.blacklisted = false
+	target.lastUpdate = time.Now()
+	target.attempts = 0
+	target.lastAttempt = time.Time{}
+
+	if target.tried {
+		idx := triedBucketFor(s, target.netaddr.IP)
+		target.bucketIdx = idx
+		addToBucket(&bk.triedBuckets[idx], s)
+	} else {
+		idx := newBucketFor(s, target.source)
+		target.bucketIdx = idx
+		addToBucket(&bk.newBuckets[idx], s)
+	}
+	bk.addrs[s] = target
+}
+
+// Shared exponential backoff parameters: a peer isn't eligible for another
+// attempt until 2^count * retryBackoffBase has elapsed since the last one,
+// capped at retryBackoffCap so a persistently unreachable peer is still
+// retried eventually rather than never. This paces both pre-blacklist
+// connection attempts (MarkAttempt/MarkBad, via PickAddress) and blacklisted
+// peers waiting to be re-probed (RetryBlacklist).
+const (
+	retryBackoffBase        = 30 * time.Second
+	retryBackoffCap         = 24 * time.Hour
+	blacklistRetrySelectPct = 25
+	maxRetryBackoffShift    = 20 // 2^20 * 30s would already exceed the cap
+)
+
+// backoffElapsed reports whether 2^count * retryBackoffBase (capped at
+// retryBackoffCap) has elapsed since since.
+func backoffElapsed(since time.Time, count int) bool {
+	shift := count
+	if shift > maxRetryBackoffShift {
+		shift = maxRetryBackoffShift
 	}
+	backoff := retryBackoffBase * time.Duration(uint64(1)<<uint(shift))
+	if backoff > retryBackoffCap {
+		backoff = retryBackoffCap
+	}
+	return time.Since(since) >= backoff
+}
+
+func blacklistRetryReady(addr *Address) bool {
+	return backoffElapsed(addr.blacklistedAt, addr.retryCount)
+}
+
+// attemptRetryReady reports whether enough time has passed since an
+// address's last failed connection attempt for PickAddress to offer it
+// again. An address with no recorded attempts is always ready.
+func attemptRetryReady(addr *Address) bool {
+	if addr.attempts == 0 {
+		return true
+	}
+	return backoffElapsed(addr.lastAttempt, addr.attempts)
+}
+
+// RetryBlacklist returns a random ~25% sample of blacklisted addresses whose
+// backoff has elapsed, for re-probing. Each returned address has its
+// retryCount bumped immediately, which is what grows its backoff whether or
+// not the resulting probe succeeds; a successful probe should still call
+// Redeem to move the address back into the active tables.
+func (bk *AddressBook) RetryBlacklist() []*Address {
+	bk.addrState.Lock()
+	defer bk.addrState.Unlock()
+
+	var selected []*Address
+	for _, addr := range bk.blacklist {
+		if !blacklistRetryReady(addr) {
+			continue
+		}
+		if rand.Intn(100) >= blacklistRetrySelectPct {
+			continue
+		}
+		addr.retryCount++
+		selected = append(selected, addr)
+	}
+
+	return selected
 }
 
 // Touch updates the last-seen timestamp if the peer is in the address book or does nothing if not.
 func (bk *AddressBook) Touch(s PeerKey) {
 	bk.addrState.Lock()
-	defer bk.addrState.Unlock()
 
-	if target, ok := bk.addrs[s]; ok {
-		target.lastUpdate = time.Now()
+	_, known := bk.addrs[s]
+	if known {
+		bk.addrs[s].lastUpdate = time.Now()
+	}
+
+	bk.addrState.Unlock()
+
+	if known {
+		bk.appendJournal(journalRecord{Event: journalEventTouch, Key: string(s)})
 	}
 }
 
@@ -145,32 +537,120 @@ func (bk *AddressBook) IsBlacklisted(s PeerKey) bool {
 	bk.addrState.RLock()
 	defer bk.addrState.RUnlock()
 
-	if target, ok := bk.addrs[s]; ok {
-		return target.blacklisted
+	_, blacklisted := bk.blacklist[s]
+	return blacklisted
+}
+
+// PickAddress selects a random, non-blacklisted address for an outbound
+// connection attempt. biasTowardNew is the percentage chance, 0-100, that a
+// new-table bucket is consulted instead of a tried-table one. Within the
+// chosen bucket, entries are weighted toward the most recently added end of
+// the bucket by drawing two candidates and keeping the fresher one. An
+// address that has failed recently is skipped until its own attempt backoff
+// (see attemptRetryReady) has elapsed, so a single address can't be handed
+// out over and over with no pacing between tries.
+func (bk *AddressBook) PickAddress(biasTowardNew int) *Address {
+	bk.addrState.RLock()
+	defer bk.addrState.RUnlock()
+
+	useNew := rand.Intn(100) < biasTowardNew
+	buckets := bk.triedBuckets[:]
+	if useNew {
+		buckets = bk.newBuckets[:]
+	}
+
+	nonEmpty := make([]int, 0, len(buckets))
+	for i := range buckets {
+		if len(buckets[i]) > 0 {
+			nonEmpty = append(nonEmpty, i)
+		}
+	}
+	rand.Shuffle(len(nonEmpty), func(i, j int) { nonEmpty[i], nonEmpty[j] = nonEmpty[j], nonEmpty[i] })
+
+	for _, bi := range nonEmpty {
+		bucket := buckets[bi]
+
+		ready := make([]PeerKey, 0, len(bucket))
+		for _, key := range bucket {
+			if addr, ok := bk.addrs[key]; ok && attemptRetryReady(addr) {
+				ready = append(ready, key)
+			}
+		}
+		if len(ready) == 0 {
+			continue
+		}
+
+		i, j := rand.Intn(len(ready)), rand.Intn(len(ready))
+		if j > i {
+			i = j
+		}
+		return bk.addrs[ready[i]]
 	}
 
-	return false
+	return nil
 }
 
-// WaitForAddresses waits for n addresses to be received and their initial
-// connection attempts to resolve. There is no escape if that does not happen -
-// this is intended for test runners or goroutines with a timeout.
-func (bk *AddressBook) waitForAddresses(n int, done chan struct{}) {
-	bk.addrState.Lock()
+// ErrAddressTimeout is returned by WaitForAddresses when timeout elapses
+// before n addresses have been received.
+var ErrAddressTimeout = errors.New("address book: timed out waiting for addresses")
+
+// WaitForAddresses blocks until n addresses have been received or timeout
+// elapses, whichever comes first, returning ErrAddressTimeout in the latter
+// case. This bounds the initial bootstrap wait: a bootstrap peer that never
+// sends any addresses no longer blocks its caller forever.
+func (bk *AddressBook) WaitForAddresses(n int, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
 	for {
+		bk.addrState.RLock()
 		addrCount := len(bk.addrs)
-		if addrCount < n {
-			bk.addrRecvCond.Wait()
-		} else {
-			break
+		bk.addrState.RUnlock()
+		if addrCount >= n {
+			return nil
+		}
+
+		select {
+		case <-bk.addrRecv:
+		case <-timer.C:
+			return ErrAddressTimeout
 		}
 	}
-	bk.addrState.Unlock()
-	done <- struct{}{}
-	return
 }
 
-// GetShuffledAddressList returns a slice of n valid addresses in random order.
-// func (bk *AddressBook) GetShuffledAddressList(n int) []*Address {
+// GetShuffledAddressList returns up to n addresses with at most one address
+// per netgroup (see Address.Group), so that a single hosting provider or
+// netblock cannot dominate a single DNS answer the way it could dominate a
+// bucket. Netgroups with fewer members are favored, so a handful of
+// addresses spread across distinct netgroups are returned ahead of any
+// address from a netgroup we've seen many of.
+func (bk *AddressBook) GetShuffledAddressList(n int) []*Address {
+	bk.addrState.RLock()
+	defer bk.addrState.RUnlock()
+
+	byGroup := make(map[string][]*Address)
+	for _, addr := range bk.addrs {
+		g := addr.Group()
+		byGroup[g] = append(byGroup[g], addr)
+	}
+
+	groups := make([]string, 0, len(byGroup))
+	for g := range byGroup {
+		groups = append(groups, g)
+	}
+	rand.Shuffle(len(groups), func(i, j int) { groups[i], groups[j] = groups[j], groups[i] })
+	sort.SliceStable(groups, func(i, j int) bool {
+		return len(byGroup[groups[i]]) < len(byGroup[groups[j]])
+	})
 
-// }
+	result := make([]*Address, 0, n)
+	for _, g := range groups {
+		if len(result) >= n {
+			break
+		}
+		members := byGroup[g]
+		result = append(result, members[rand.Intn(len(members))])
+	}
+
+	return result
+}
@@ -0,0 +1,429 @@
+package zcash
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotMagic and snapshotVersion identify the on-disk format written by
+// SaveToFile, so LoadFromFile can refuse to parse a file from an
+// incompatible future version rather than silently misreading it.
+const (
+	snapshotMagic   = "ZADB"
+	snapshotVersion = 1
+)
+
+// addressRecord is the serialized form of an Address. It is deliberately
+// separate from Address so the on-disk format doesn't shift every time an
+// in-memory field is added or renamed.
+type addressRecord struct {
+	Key           string
+	IP            string
+	Port          uint16
+	Blacklisted   bool
+	BlacklistedAt time.Time
+	RetryCount    int
+	LastUpdate    time.Time
+	Source        string
+	Attempts      int
+	LastAttempt   time.Time
+	LastSuccess   time.Time
+	Tried         bool
+}
+
+func (a *Address) toRecord(key PeerKey) addressRecord {
+	return addressRecord{
+		Key:           string(key),
+		IP:            a.netaddr.IP.String(),
+		Port:          a.netaddr.Port,
+		Blacklisted:   a.blacklisted,
+		BlacklistedAt: a.blacklistedAt,
+		RetryCount:    a.retryCount,
+		LastUpdate:    a.lastUpdate,
+		Source:        a.source.String(),
+		Attempts:      a.attempts,
+		LastAttempt:   a.lastAttempt,
+		LastSuccess:   a.lastSuccess,
+		Tried:         a.tried,
+	}
+}
+
+func (rec addressRecord) toAddress() (PeerKey, *Address, error) {
+	key := PeerKey(rec.Key)
+	addr, err := (&Address{}).fromPeerKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+	addr.blacklisted = rec.Blacklisted
+	addr.blacklistedAt = rec.BlacklistedAt
+	addr.retryCount = rec.RetryCount
+	addr.lastUpdate = rec.LastUpdate
+	addr.source = net.ParseIP(rec.Source)
+	addr.attempts = rec.Attempts
+	addr.lastAttempt = rec.LastAttempt
+	addr.lastSuccess = rec.LastSuccess
+	addr.tried = rec.Tried
+	return key, addr, nil
+}
+
+// writeFrame writes payload as a length-prefixed record with a CRC32 header,
+// so a truncated or bit-flipped record can be detected on read instead of
+// silently corrupting the book.
+func writeFrame(w io.Writer, payload []byte) error {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readFrame reads one frame written by writeFrame. It returns io.EOF only
+// when the stream ends cleanly on a frame boundary.
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	wantCRC := binary.BigEndian.Uint32(header[4:8])
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			// The header was read but the payload is missing: a torn
+			// frame, not a clean end of stream.
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if gotCRC := crc32.ChecksumIEEE(payload); gotCRC != wantCRC {
+		return nil, fmt.Errorf("address book: corrupt record (crc32 mismatch)")
+	}
+	return payload, nil
+}
+
+func encodeRecord(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SaveToFile writes the full contents of the address book to path as an
+// atomic snapshot: it is built up in a temp file in the same directory and
+// then renamed into place, so a crash or concurrent read never observes a
+// partially written book. Once the snapshot lands, any journal kept via
+// EnableJournal is reset, since the snapshot now reflects everything in it.
+func (bk *AddressBook) SaveToFile(path string) error {
+	bk.addrState.RLock()
+	records := make([]addressRecord, 0, len(bk.addrs)+len(bk.blacklist))
+	for key, addr := range bk.addrs {
+		records = append(records, addr.toRecord(key))
+	}
+	for key, addr := range bk.blacklist {
+		records = append(records, addr.toRecord(key))
+	}
+	bk.addrState.RUnlock()
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // no-op once the rename below succeeds
+
+	bw := bufio.NewWriter(tmp)
+
+	var header [16]byte
+	copy(header[0:4], snapshotMagic)
+	binary.BigEndian.PutUint32(header[4:8], snapshotVersion)
+	binary.BigEndian.PutUint64(header[8:16], uint64(len(records)))
+	if _, err := bw.Write(header[:]); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	for _, rec := range records {
+		payload, err := encodeRecord(rec)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := writeFrame(bw, payload); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	return bk.resetJournal()
+}
+
+// LoadFromFile replaces the address book's contents with the snapshot at
+// path, then replays any journal found alongside it (path + ".journal") to
+// recover events recorded since that snapshot was taken. It should be called
+// before EnableJournal, since replayed events are not re-journaled.
+func (bk *AddressBook) LoadFromFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+
+	var header [16]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return err
+	}
+	if string(header[0:4]) != snapshotMagic {
+		return fmt.Errorf("address book: %s is not a valid snapshot", path)
+	}
+	if version := binary.BigEndian.Uint32(header[4:8]); version != snapshotVersion {
+		return fmt.Errorf("address book: unsupported snapshot version %d", version)
+	}
+	count := binary.BigEndian.Uint64(header[8:16])
+
+	addrs := make(map[PeerKey]*Address, count)
+	blacklist := make(map[PeerKey]*Address)
+	var newBuckets [numNewBuckets][]PeerKey
+	var triedBuckets [numTriedBuckets][]PeerKey
+
+	for i := uint64(0); i < count; i++ {
+		payload, err := readFrame(br)
+		if err != nil {
+			return err
+		}
+
+		var rec addressRecord
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+			return err
+		}
+
+		key, addr, err := rec.toAddress()
+		if err != nil {
+			// XXX skip bogus records rather than failing the whole load
+			continue
+		}
+
+		if addr.blacklisted {
+			blacklist[key] = addr
+			continue
+		}
+
+		addrs[key] = addr
+
+		if addr.tried {
+			idx := triedBucketFor(key, addr.netaddr.IP)
+			addr.bucketIdx = idx
+			if evicted, didEvict := addToBucket(&triedBuckets[idx], key); didEvict {
+				demoteLoadedAddress(addrs, newBuckets[:], evicted)
+			}
+		} else {
+			idx := newBucketFor(key, addr.source)
+			addr.bucketIdx = idx
+			if evicted, didEvict := addToBucket(&newBuckets[idx], key); didEvict {
+				// The new bucket it landed in was already full; the
+				// address that lost that race is dropped, same as Add.
+				delete(addrs, evicted)
+			}
+		}
+	}
+
+	bk.addrState.Lock()
+	bk.addrs = addrs
+	bk.blacklist = blacklist
+	bk.newBuckets = newBuckets
+	bk.triedBuckets = triedBuckets
+	bk.addrState.Unlock()
+
+	return bk.replayJournal(journalPathFor(path))
+}
+
+// RunSnapshotLoop periodically calls SaveToFile(path) until stop is closed,
+// and once more before returning so a graceful shutdown always leaves a
+// fresh snapshot on disk. Errors from the periodic saves are discarded and do
+// not stop the loop; only the error from the final save is returned.
+func (bk *AddressBook) RunSnapshotLoop(path string, interval time.Duration, stop <-chan struct{}) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			bk.SaveToFile(path)
+		case <-stop:
+			return bk.SaveToFile(path)
+		}
+	}
+}
+
+// demoteLoadedAddress mirrors the eviction path in MarkGood: an address
+// bumped out of a full tried bucket is moved back into a new bucket rather
+// than discarded, cascading to a drop only if that new bucket is also full.
+func demoteLoadedAddress(addrs map[PeerKey]*Address, newBuckets [][]PeerKey, key PeerKey) {
+	addr, ok := addrs[key]
+	if !ok {
+		return
+	}
+
+	addr.tried = false
+	idx := newBucketFor(key, addr.source)
+	addr.bucketIdx = idx
+	if evicted, didEvict := addToBucket(&newBuckets[idx], key); didEvict {
+		delete(addrs, evicted)
+	}
+}
+
+func journalPathFor(snapshotPath string) string {
+	return snapshotPath + ".journal"
+}
+
+type journalEvent byte
+
+const (
+	journalEventAdd journalEvent = iota + 1
+	journalEventBlacklist
+	journalEventTouch
+)
+
+type journalRecord struct {
+	Event  journalEvent
+	Key    string
+	Source string
+}
+
+// EnableJournal opens the append-only journal alongside snapshotPath so that
+// subsequent Add/Blacklist/Touch calls are durable between snapshots. Call
+// LoadFromFile first: events replayed from an existing journal are not
+// re-journaled, which would otherwise duplicate them on the next load.
+func (bk *AddressBook) EnableJournal(snapshotPath string) error {
+	f, err := os.OpenFile(journalPathFor(snapshotPath), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	bk.journalMu.Lock()
+	defer bk.journalMu.Unlock()
+	bk.journalFile = f
+	bk.journalPath = journalPathFor(snapshotPath)
+	return nil
+}
+
+// CloseJournal closes the journal file, if one is open. It should be called
+// during graceful shutdown alongside a final SaveToFile.
+func (bk *AddressBook) CloseJournal() error {
+	bk.journalMu.Lock()
+	defer bk.journalMu.Unlock()
+
+	if bk.journalFile == nil {
+		return nil
+	}
+	err := bk.journalFile.Close()
+	bk.journalFile = nil
+	return err
+}
+
+// resetJournal truncates the journal file after a successful snapshot, since
+// the snapshot now captures everything the journal had recorded.
+func (bk *AddressBook) resetJournal() error {
+	bk.journalMu.Lock()
+	defer bk.journalMu.Unlock()
+
+	if bk.journalFile == nil {
+		return nil
+	}
+	if err := bk.journalFile.Truncate(0); err != nil {
+		return err
+	}
+	_, err := bk.journalFile.Seek(0, io.SeekStart)
+	return err
+}
+
+func (bk *AddressBook) appendJournal(rec journalRecord) {
+	bk.journalMu.Lock()
+	defer bk.journalMu.Unlock()
+
+	if bk.journalFile == nil {
+		return
+	}
+
+	payload, err := encodeRecord(rec)
+	if err != nil {
+		return
+	}
+	// XXX a failed journal write is not fatal to the caller; the next
+	// periodic snapshot will still capture the current in-memory state.
+	_ = writeFrame(bk.journalFile, payload)
+}
+
+// replayJournal applies every event recorded at path, in order, to bk. A
+// missing journal (the common case right after a clean shutdown) is not an
+// error.
+func (bk *AddressBook) replayJournal(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	for {
+		payload, err := readFrame(br)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// A torn final write is expected if the process crashed
+			// mid-append; stop replaying rather than failing the load.
+			break
+		}
+
+		var rec journalRecord
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&rec); err != nil {
+			break
+		}
+
+		switch rec.Event {
+		case journalEventAdd:
+			bk.Add(PeerKey(rec.Key), net.ParseIP(rec.Source))
+		case journalEventBlacklist:
+			bk.Blacklist(PeerKey(rec.Key))
+		case journalEventTouch:
+			bk.Touch(PeerKey(rec.Key))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package zcash
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestGetShuffledAddressListNetgroupDiversity(t *testing.T) {
+	bk := NewAddressBook()
+
+	// 100 addresses crammed into a single /16.
+	for i := 0; i < 100; i++ {
+		ip := fmt.Sprintf("203.0.0.%d", i+1)
+		bk.Add(PeerKey(net.JoinHostPort(ip, "8233")), net.ParseIP(ip))
+	}
+
+	// 5 addresses, each in its own distinct /16.
+	diverse := make([]PeerKey, 0, 5)
+	for i := 0; i < 5; i++ {
+		ip := fmt.Sprintf("10.%d.0.1", i+1)
+		key := PeerKey(net.JoinHostPort(ip, "8233"))
+		bk.Add(key, net.ParseIP(ip))
+		diverse = append(diverse, key)
+	}
+
+	result := bk.GetShuffledAddressList(5)
+	if len(result) != 5 {
+		t.Fatalf("expected 5 addresses, got %d", len(result))
+	}
+
+	seenGroups := make(map[string]int)
+	got := make(map[PeerKey]bool, len(result))
+	for _, addr := range result {
+		got[addr.asPeerKey()] = true
+		seenGroups[addr.Group()]++
+	}
+
+	for group, count := range seenGroups {
+		if count > 1 {
+			t.Errorf("netgroup %s contributed %d addresses, want at most 1", group, count)
+		}
+	}
+
+	for _, key := range diverse {
+		if !got[key] {
+			t.Errorf("expected diverse address %s in a netgroup-diverse top-5 selection, got %v", key, result)
+		}
+	}
+}